@@ -0,0 +1,290 @@
+package getsong
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"gopkg.in/cheggaaa/pb.v1"
+)
+
+// BatchOptions describes a batch of songs to fetch, either from a YouTube
+// playlist/channel URL or from a CSV manifest of title,artist[,duration] rows.
+type BatchOptions struct {
+	PlaylistURL  string
+	ChannelURL   string
+	CSVFile      string
+	OutputDir    string
+	Workers      int
+	ShowProgress bool
+	Debug        bool
+	// YtDlp configures the yt-dlp/youtube-dl backend used to fetch each track.
+	YtDlp YtDlpOptions
+	// Context, if set, is threaded through every lookup, download and
+	// transcode in the batch so the whole run can be canceled or timed out.
+	// Defaults to context.Background().
+	Context context.Context
+}
+
+// BatchResult is the outcome of downloading a single track as part of a batch.
+type BatchResult struct {
+	Title    string
+	Artist   string
+	Filename string
+	Skipped  bool
+	Err      error
+}
+
+type batchJob struct {
+	title    string
+	artist   string
+	duration int
+	videoID  string
+}
+
+// GetSongs downloads every track described by options concurrently using a
+// worker pool, skipping files that already exist in OutputDir and collecting
+// per-track errors instead of aborting on the first failure.
+func GetSongs(options BatchOptions) (results []BatchResult, err error) {
+	if options.Debug {
+		setLogLevel("debug")
+	} else {
+		setLogLevel("info")
+	}
+	ctx := options.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	jobs, err := batchJobs(ctx, options)
+	if err != nil {
+		err = errors.Wrap(err, "could not build batch job list")
+		return
+	}
+	if len(jobs) == 0 {
+		err = fmt.Errorf("no tracks found for batch")
+		return
+	}
+
+	if options.OutputDir == "" {
+		options.OutputDir = "."
+	}
+	if err = os.MkdirAll(options.OutputDir, 0755); err != nil {
+		return
+	}
+
+	workers := options.Workers
+	if workers < 1 {
+		workers = 4
+	}
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+
+	jobChan := make(chan batchJob)
+	resultChan := make(chan BatchResult)
+
+	var pool *pb.Pool
+	bars := make([]*pb.ProgressBar, workers)
+	if options.ShowProgress {
+		for i := range bars {
+			// Jobs are pulled from jobChan on demand, so there's no way to
+			// know in advance how many a given worker will run. Drive each
+			// bar as an indeterminate "jobs done" counter instead of a
+			// percentage against a guessed total.
+			bars[i] = pb.New(0)
+			bars[i].ShowBar = false
+			bars[i].ShowPercent = false
+			bars[i].ShowTimeLeft = false
+			bars[i].ShowCounters = true
+			bars[i].Prefix(fmt.Sprintf("worker %d: idle", i+1))
+		}
+		pool, err = pb.StartPool(bars...)
+		if err != nil {
+			return
+		}
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(workerID int) {
+			defer wg.Done()
+			for job := range jobChan {
+				if options.ShowProgress {
+					bars[workerID].Prefix(fmt.Sprintf("worker %d: %s", workerID+1, batchJobLabel(job)))
+				}
+				resultChan <- runBatchJob(ctx, job, options.OutputDir, options.YtDlp)
+				if options.ShowProgress {
+					bars[workerID].Increment()
+				}
+			}
+		}(w)
+	}
+
+	go func() {
+		for _, job := range jobs {
+			jobChan <- job
+		}
+		close(jobChan)
+		wg.Wait()
+		close(resultChan)
+	}()
+
+	for result := range resultChan {
+		results = append(results, result)
+	}
+
+	if pool != nil {
+		pool.Stop()
+	}
+
+	var failed int
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			log.Errorf("batch: %s - %s: %s", result.Artist, result.Title, result.Err)
+		}
+	}
+	if failed > 0 {
+		err = fmt.Errorf("%d of %d tracks failed", failed, len(results))
+	}
+	return
+}
+
+func batchJobLabel(job batchJob) string {
+	if job.videoID != "" {
+		return job.videoID
+	}
+	if job.artist != "" {
+		return job.artist + " - " + job.title
+	}
+	return job.title
+}
+
+// runBatchJob downloads and converts a single job, skipping it if the
+// sanitized output filename already exists.
+func runBatchJob(ctx context.Context, job batchJob, outputDir string, ytDlpOpts YtDlpOptions) (result BatchResult) {
+	result.Title = job.title
+	result.Artist = job.artist
+
+	savedFilename := sanitizeFileNamePart(job.artist)
+	if savedFilename != "" {
+		savedFilename += " - "
+	}
+	savedFilename += sanitizeFileNamePart(job.title)
+	if savedFilename == "" {
+		savedFilename = job.videoID
+	}
+
+	fullPath := filepath.Join(outputDir, savedFilename+".mp3")
+	if _, statErr := os.Stat(fullPath); statErr == nil {
+		result.Filename = fullPath
+		result.Skipped = true
+		return
+	}
+
+	youtubeID := job.videoID
+	var err error
+	if youtubeID == "" {
+		if job.duration > 0 {
+			youtubeID, err = getMusicVideoID(ctx, job.title, job.title+" "+job.artist, job.duration)
+		} else {
+			youtubeID, err = getMusicVideoID(ctx, job.title, job.title+" "+job.artist)
+		}
+		if err != nil {
+			result.Err = errors.Wrap(err, "could not get youtube ID")
+			return
+		}
+	}
+
+	downloadedFilename, err := downloadYouTube(ctx, pickDownloader(BackendAuto, ytDlpOpts), youtubeID, filepath.Join(outputDir, savedFilename))
+	if err != nil {
+		result.Err = errors.Wrap(err, "could not download video")
+		return
+	}
+
+	if err = convertToMp3(ctx, downloadedFilename); err != nil {
+		result.Err = errors.Wrap(err, "could not convert video")
+		return
+	}
+
+	result.Filename = fullPath
+	return
+}
+
+// batchJobs resolves a BatchOptions into the concrete list of jobs to run.
+func batchJobs(ctx context.Context, options BatchOptions) (jobs []batchJob, err error) {
+	switch {
+	case options.CSVFile != "":
+		return parseCSVManifest(options.CSVFile)
+	case options.PlaylistURL != "":
+		ids, errIDs := getVideoIDsFromURL(ctx, options.PlaylistURL)
+		if errIDs != nil {
+			return nil, errIDs
+		}
+		for _, id := range ids {
+			jobs = append(jobs, batchJob{videoID: id})
+		}
+		return
+	case options.ChannelURL != "":
+		ids, errIDs := getVideoIDsFromURL(ctx, options.ChannelURL)
+		if errIDs != nil {
+			return nil, errIDs
+		}
+		for _, id := range ids {
+			jobs = append(jobs, batchJob{videoID: id})
+		}
+		return
+	default:
+		err = fmt.Errorf("must provide a PlaylistURL, ChannelURL or CSVFile")
+		return
+	}
+}
+
+// parseCSVManifest reads rows of title,artist[,duration] from a CSV file.
+func parseCSVManifest(filename string) (jobs []batchJob, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	for {
+		record, errRead := reader.Read()
+		if errRead == io.EOF {
+			break
+		}
+		if errRead != nil {
+			err = errRead
+			return
+		}
+		if len(record) == 0 || strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		job := batchJob{title: strings.TrimSpace(record[0])}
+		if len(record) > 1 {
+			job.artist = strings.TrimSpace(record[1])
+		}
+		if len(record) > 2 && strings.TrimSpace(record[2]) != "" {
+			duration, errConv := strconv.Atoi(strings.TrimSpace(record[2]))
+			if errConv == nil {
+				job.duration = duration
+			}
+		}
+		jobs = append(jobs, job)
+	}
+	return
+}
@@ -0,0 +1,231 @@
+package getsong
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+// requestTimeout bounds a single HTTP round trip made by this package.
+const requestTimeout = 30 * time.Second
+
+// maxRetries is how many times a 429/5xx response is retried before giving up.
+const maxRetries = 5
+
+var defaultHTTPClient = &http.Client{Timeout: requestTimeout}
+
+// ProxyPool is a round-robin pool of outbound proxies and/or source IPs used
+// to spread requests across multiple egress points, mirroring the IP
+// rotation strategies used by other YouTube downloader tools to dodge rate
+// limiting.
+type ProxyPool struct {
+	mu      sync.Mutex
+	clients []*http.Client
+	next    int
+}
+
+// NewProxyPool builds a ProxyPool from proxy URLs (e.g. "socks5://host:port")
+// and/or outbound source IPs. At least one of the two may be empty, but not
+// both. If both are given they're paired index-wise; the longer list wins
+// and the shorter one's last entry is reused for the remainder.
+func NewProxyPool(proxyURLs []string, sourceIPs []string) (*ProxyPool, error) {
+	count := len(proxyURLs)
+	if len(sourceIPs) > count {
+		count = len(sourceIPs)
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("must provide at least one proxy URL or source IP")
+	}
+
+	pool := &ProxyPool{}
+	for i := 0; i < count; i++ {
+		transport := &http.Transport{}
+
+		if len(proxyURLs) > 0 {
+			raw := proxyURLs[i%len(proxyURLs)]
+			proxyURL, err := url.Parse(raw)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid proxy url %q", raw)
+			}
+			transport.Proxy = http.ProxyURL(proxyURL)
+		}
+
+		if len(sourceIPs) > 0 {
+			raw := sourceIPs[i%len(sourceIPs)]
+			ip := net.ParseIP(raw)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid source ip %q", raw)
+			}
+			dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: ip}, Timeout: requestTimeout}
+			transport.DialContext = dialer.DialContext
+		}
+
+		pool.clients = append(pool.clients, &http.Client{Transport: transport, Timeout: requestTimeout})
+	}
+	return pool, nil
+}
+
+// next returns the next client in the pool, round-robin.
+func (p *ProxyPool) nextClient() *http.Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	client := p.clients[p.next%len(p.clients)]
+	p.next++
+	return client
+}
+
+// globalProxyPool, when set via SetProxyPool, is consulted for every outbound
+// request this package makes.
+var globalProxyPool *ProxyPool
+
+// SetProxyPool installs a pool of outbound proxies/source IPs that subsequent
+// requests are spread across round-robin. Pass nil to go back to the default
+// client.
+func SetProxyPool(pool *ProxyPool) {
+	globalProxyPool = pool
+}
+
+func httpClientForRequest() *http.Client {
+	if globalProxyPool != nil {
+		return globalProxyPool.nextClient()
+	}
+	return defaultHTTPClient
+}
+
+// doWithRetry performs req, retrying on 429/5xx responses with exponential
+// backoff, honoring a Retry-After header when the server sends one, and
+// aborting immediately if ctx is canceled. Request bodies are rewound via
+// req.GetBody before each retry, since the body was already drained by the
+// previous attempt.
+func doWithRetry(ctx context.Context, req *http.Request) (resp *http.Response, err error) {
+	client := httpClientForRequest()
+	backoff := 500 * time.Millisecond
+
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, errBody := req.GetBody()
+			if errBody != nil {
+				return nil, errBody
+			}
+			req.Body = body
+		}
+		resp, err = client.Do(req.WithContext(ctx))
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			return
+		}
+
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			return resp, nil
+		}
+
+		wait := retryAfterDuration(resp.Header.Get("Retry-After"), backoff)
+		resp.Body.Close()
+		log.Debugf("got status %d from %s, retrying in %s (attempt %d/%d)", resp.StatusCode, req.URL, wait, attempt+1, maxRetries)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+	err = fmt.Errorf("giving up on %s after %d retries", req.URL, maxRetries)
+	return
+}
+
+// retryAfterDuration parses a Retry-After header (either delta-seconds or an
+// HTTP-date), falling back to the given default backoff if absent/unparsable.
+func retryAfterDuration(header string, fallback time.Duration) time.Duration {
+	if header == "" {
+		return fallback
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(header); err == nil {
+		if wait := time.Until(when); wait > 0 {
+			return wait
+		}
+	}
+	return fallback
+}
+
+// GetSongContext is the cancelable, context-aware variant of GetSong. It
+// threads ctx through every HTTP request and external command the lookup,
+// download and transcode steps make, so a caller can time it out or abort it.
+func GetSongContext(ctx context.Context, options Options) (savedFilename string, err error) {
+	if options.Debug {
+		setLogLevel("debug")
+	} else {
+		setLogLevel("info")
+	}
+	optionShowProgressBar = options.ShowProgress
+
+	if options.Title == "" {
+		err = fmt.Errorf("must enter title")
+		return
+	}
+
+	searchTerm := options.Title
+	if options.Artist != "" {
+		searchTerm += " " + options.Artist
+		savedFilename = options.Artist
+	}
+	if savedFilename != "" {
+		savedFilename += " - "
+	}
+	savedFilename += options.Title
+
+	var youtubeID string
+	if options.Duration > 0 {
+		youtubeID, err = getMusicVideoID(ctx, options.Title, searchTerm, options.Duration)
+	} else {
+		youtubeID, err = getMusicVideoID(ctx, options.Title, searchTerm)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "could not get youtube ID")
+		return
+	}
+
+	if !options.DoNotDownload {
+		var fname string
+		fname, err = downloadYouTube(ctx, pickDownloader(options.Backend, options.YtDlp), youtubeID, savedFilename)
+		if err != nil {
+			err = errors.Wrap(err, "could not downlaod video")
+			return
+		}
+
+		transcodeOpts := options.Transcode
+		if transcodeOpts.Codec == "" {
+			transcodeOpts.Codec = "mp3"
+		}
+		if transcodeOpts.Title == "" {
+			transcodeOpts.Title = options.Title
+		}
+		if transcodeOpts.Artist == "" {
+			transcodeOpts.Artist = options.Artist
+		}
+		if transcodeOpts.CoverArtURL == "" {
+			transcodeOpts.CoverArtURL = youtubeThumbnailURL(youtubeID)
+		}
+		savedFilename, err = Transcode(ctx, fname, transcodeOpts)
+		if err != nil {
+			err = errors.Wrap(err, "could not convert video")
+			return
+		}
+	} else {
+		savedFilename += ".mp3"
+	}
+	return
+}
@@ -0,0 +1,271 @@
+package getsong
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+
+	log "github.com/cihub/seelog"
+	"github.com/otium/ytdl"
+	"github.com/pkg/errors"
+	"gopkg.in/cheggaaa/pb.v1"
+)
+
+// Backend selects which downloader implementation fetches audio from YouTube.
+type Backend string
+
+const (
+	// BackendAuto picks yt-dlp/youtube-dl if one is on the PATH, otherwise
+	// falls back to the pure-Go ytdl extractor.
+	BackendAuto Backend = ""
+	// BackendYtdl forces the otium/ytdl pure-Go extractor.
+	BackendYtdl Backend = "ytdl"
+	// BackendYtDlp forces shelling out to yt-dlp (or youtube-dl).
+	BackendYtDlp Backend = "yt-dlp"
+)
+
+// YtDlpOptions configures the yt-dlp/youtube-dl backend. It's ignored when
+// the ytdl backend is in use.
+type YtDlpOptions struct {
+	// Format is passed as --format, e.g. "bestaudio". Defaults to "bestaudio/best".
+	Format string
+	// ExternalDownloader, if set, is passed as --external-downloader (e.g. "aria2c").
+	ExternalDownloader string
+	// PreferFFmpeg passes --prefer-ffmpeg when true.
+	PreferFFmpeg bool
+}
+
+// VideoInfo is the subset of a video's metadata a Downloader needs to expose.
+type VideoInfo struct {
+	ID            string
+	Title         string
+	BestExtension string
+}
+
+// Downloader abstracts fetching video info and streaming audio for a video ID,
+// so GetSong can be backed by the pure-Go ytdl extractor or an external tool
+// like yt-dlp without changing its own logic.
+type Downloader interface {
+	Info(ctx context.Context, id string) (VideoInfo, error)
+	Download(ctx context.Context, id string, format string, w io.Writer) error
+}
+
+// ytDlpBinary and youtubeDlBinary are resolved once at init time.
+var ytDlpBinary string
+
+func init() {
+	for _, candidate := range []string{"yt-dlp", "youtube-dl"} {
+		if path, err := exec.LookPath(candidate); err == nil {
+			ytDlpBinary = path
+			break
+		}
+	}
+}
+
+// pickDownloader resolves a Backend into a concrete Downloader, auto-detecting
+// yt-dlp/youtube-dl when the caller didn't force a backend, and applying
+// ytDlpOpts when the resolved backend is yt-dlp/youtube-dl.
+func pickDownloader(backend Backend, ytDlpOpts YtDlpOptions) Downloader {
+	newYtDlpDownloader := func() YtDlpDownloader {
+		return YtDlpDownloader{
+			Binary:             ytDlpBinary,
+			Format:             ytDlpOpts.Format,
+			ExternalDownloader: ytDlpOpts.ExternalDownloader,
+			PreferFFmpeg:       ytDlpOpts.PreferFFmpeg,
+		}
+	}
+	switch backend {
+	case BackendYtdl:
+		return ytdlDownloader{}
+	case BackendYtDlp:
+		return newYtDlpDownloader()
+	default:
+		if ytDlpBinary != "" {
+			return newYtDlpDownloader()
+		}
+		return ytdlDownloader{}
+	}
+}
+
+// ytdlDownloader backs onto the pure-Go otium/ytdl extractor.
+type ytdlDownloader struct{}
+
+func (ytdlDownloader) Info(ctx context.Context, id string) (info VideoInfo, err error) {
+	videoInfo, err := ytdl.GetVideoInfo(id)
+	if err != nil {
+		return
+	}
+	bestQuality := 0
+	var bestFormat ytdl.Format
+	for _, f := range videoInfo.Formats {
+		if f.VideoEncoding == "" && f.AudioBitrate > bestQuality {
+			bestQuality = f.AudioBitrate
+			bestFormat = f
+		}
+	}
+	if bestQuality == 0 {
+		err = fmt.Errorf("no audio available")
+		return
+	}
+	info = VideoInfo{ID: id, Title: videoInfo.Title, BestExtension: bestFormat.Extension}
+	return
+}
+
+func (ytdlDownloader) Download(ctx context.Context, id string, format string, w io.Writer) (err error) {
+	videoInfo, err := ytdl.GetVideoInfo(id)
+	if err != nil {
+		err = fmt.Errorf("unable to fetch video info: %s", err.Error())
+		return
+	}
+	bestQuality := 0
+	var bestFormat ytdl.Format
+	for _, f := range videoInfo.Formats {
+		if f.VideoEncoding == "" && f.AudioBitrate > bestQuality {
+			bestQuality = f.AudioBitrate
+			bestFormat = f
+		}
+	}
+	if bestQuality == 0 {
+		err = fmt.Errorf("no audio available")
+		return
+	}
+	downloadURL, err := videoInfo.GetDownloadURL(bestFormat)
+	if err != nil {
+		err = fmt.Errorf("unable to get download url: %s", err.Error())
+		return
+	}
+	log.Debugf("downloading %s", downloadURL)
+
+	req, err := http.NewRequest("GET", downloadURL.String(), nil)
+	if err != nil {
+		return
+	}
+	resp, err := doWithRetry(ctx, req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	return
+}
+
+// YtDlpDownloader shells out to yt-dlp (or the legacy youtube-dl) so that
+// format selection and extraction keep working when YouTube changes in ways
+// the pure-Go extractor hasn't caught up with yet.
+type YtDlpDownloader struct {
+	Binary string
+	// Format is passed as --format, e.g. "bestaudio". Defaults to "bestaudio/best".
+	Format string
+	// ExternalDownloader, if set, is passed as --external-downloader (e.g. "aria2c").
+	ExternalDownloader string
+	// PreferFFmpeg passes --prefer-ffmpeg when true.
+	PreferFFmpeg bool
+}
+
+func (d YtDlpDownloader) binary() string {
+	if d.Binary != "" {
+		return d.Binary
+	}
+	return ytDlpBinary
+}
+
+var ytDlpTitlePattern = regexp.MustCompile(`"title":\s*"((?:[^"\\]|\\.)*)"`)
+var ytDlpExtPattern = regexp.MustCompile(`"ext":\s*"([a-zA-Z0-9]+)"`)
+
+func (d YtDlpDownloader) Info(ctx context.Context, id string) (info VideoInfo, err error) {
+	binary := d.binary()
+	if binary == "" {
+		err = fmt.Errorf("yt-dlp/youtube-dl binary not found")
+		return
+	}
+	cmd := exec.CommandContext(ctx, binary, "--dump-json", "--no-playlist", fmt.Sprintf("https://www.youtube.com/watch?v=%s", id))
+	out, err := cmd.Output()
+	if err != nil {
+		err = errors.Wrap(err, "yt-dlp info failed")
+		return
+	}
+	info.ID = id
+	if match := ytDlpTitlePattern.FindSubmatch(out); match != nil {
+		info.Title = string(match[1])
+	}
+	if match := ytDlpExtPattern.FindSubmatch(out); match != nil {
+		info.BestExtension = string(match[1])
+	}
+	return
+}
+
+func (d YtDlpDownloader) Download(ctx context.Context, id string, format string, w io.Writer) (err error) {
+	binary := d.binary()
+	if binary == "" {
+		err = fmt.Errorf("yt-dlp/youtube-dl binary not found")
+		return
+	}
+	if format == "" {
+		format = d.Format
+	}
+	if format == "" {
+		format = "bestaudio/best"
+	}
+
+	args := []string{
+		"--format", format,
+		"--output", "-",
+		"--no-playlist",
+		"--newline",
+	}
+	if d.ExternalDownloader != "" {
+		args = append(args, "--external-downloader", d.ExternalDownloader)
+	}
+	if d.PreferFFmpeg {
+		args = append(args, "--prefer-ffmpeg")
+	}
+	args = append(args, fmt.Sprintf("https://www.youtube.com/watch?v=%s", id))
+
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Stdout = w
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return
+	}
+
+	if err = cmd.Start(); err != nil {
+		return
+	}
+
+	var progressBar *pb.ProgressBar
+	if optionShowProgressBar {
+		progressBar = pb.New(100)
+		progressBar.ShowCounters = false
+		progressBar.Output = os.Stderr
+		progressBar.Start()
+	}
+
+	percentPattern := regexp.MustCompile(`(\d+(?:\.\d+)?)%`)
+	scanner := bufio.NewScanner(stderr)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		log.Debugf("%s: %s", binary, line)
+		if progressBar == nil {
+			continue
+		}
+		if match := percentPattern.FindStringSubmatch(line); match != nil {
+			if percent, errConv := strconv.ParseFloat(match[1], 64); errConv == nil {
+				progressBar.Set(int(percent))
+			}
+		}
+	}
+	if progressBar != nil {
+		progressBar.Finish()
+	}
+
+	return cmd.Wait()
+}
@@ -0,0 +1,245 @@
+package getsong
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+// TranscodeOptions configures how a downloaded audio file is converted and tagged.
+type TranscodeOptions struct {
+	// Codec selects the output format: "mp3" (default), "opus", "m4a" or "flac".
+	Codec string
+	// Bitrate is a constant bitrate like "192k". Ignored if VBRQuality is set.
+	Bitrate string
+	// VBRQuality is the ffmpeg "-q:a" VBR quality level (codec-specific scale).
+	VBRQuality int
+	// Normalize applies two-pass EBU R128 loudness normalization.
+	Normalize bool
+	// TrimSilence removes leading/trailing silence before encoding.
+	TrimSilence bool
+
+	Title       string
+	Artist      string
+	Album       string
+	CoverArtURL string
+}
+
+var codecSettings = map[string]struct {
+	extension string
+	encoder   string
+}{
+	"mp3":  {"mp3", "libmp3lame"},
+	"opus": {"opus", "libopus"},
+	"m4a":  {"m4a", "aac"},
+	"flac": {"flac", "flac"},
+}
+
+// Transcode converts input to the codec described by opts, optionally
+// loudness-normalizing, trimming silence and writing ID3/Vorbis tags and
+// cover art, and returns the path to the produced file.
+func Transcode(ctx context.Context, input string, opts TranscodeOptions) (outputFilename string, err error) {
+	if err = ensureFfmpeg(ctx); err != nil {
+		return
+	}
+	if opts.Codec == "" {
+		opts.Codec = "mp3"
+	}
+	settings, ok := codecSettings[opts.Codec]
+	if !ok {
+		err = fmt.Errorf("unsupported codec %q", opts.Codec)
+		return
+	}
+
+	probe, err := probeAudio(ctx, input)
+	if err != nil {
+		err = errors.Wrap(err, "could not probe downloaded file")
+		return
+	}
+	if probe.durationSeconds() <= 0 {
+		err = fmt.Errorf("downloaded file %s has no audio duration, likely corrupt", input)
+		return
+	}
+
+	filenameWithoutExt := strings.TrimSuffix(input, filepath.Ext(input))
+	outputFilename = filenameWithoutExt + "." + settings.extension
+
+	var filters []string
+	if opts.TrimSilence {
+		filters = append(filters, "silenceremove=start_periods=1:start_threshold=-50dB:stop_periods=1:stop_threshold=-50dB")
+	}
+
+	loudnormFilter := ""
+	if opts.Normalize {
+		measured, errMeasure := measureLoudness(ctx, input)
+		if errMeasure != nil {
+			err = errors.Wrap(errMeasure, "could not measure loudness")
+			return
+		}
+		loudnormFilter = fmt.Sprintf(
+			"loudnorm=I=-16:TP=-1.5:LRA=11:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:linear=true",
+			measured.InputI, measured.InputTP, measured.InputLRA, measured.InputThresh,
+		)
+		filters = append(filters, loudnormFilter)
+	}
+
+	args := []string{"-i", input}
+
+	var coverArtFile string
+	if opts.CoverArtURL != "" {
+		coverArtFile, err = downloadCoverArt(ctx, opts.CoverArtURL, filenameWithoutExt)
+		if err != nil {
+			log.Debugf("could not fetch cover art: %s", err)
+			coverArtFile = ""
+		}
+	}
+	if coverArtFile != "" {
+		args = append(args, "-i", coverArtFile, "-map", "0:a", "-map", "1:v", "-disposition:v", "attached_pic", "-c:v", "mjpeg")
+	}
+
+	if len(filters) > 0 {
+		args = append(args, "-af", strings.Join(filters, ","))
+	}
+
+	args = append(args, "-c:a", settings.encoder)
+	if opts.VBRQuality > 0 {
+		args = append(args, "-q:a", fmt.Sprintf("%d", opts.VBRQuality))
+	} else if opts.Bitrate != "" {
+		args = append(args, "-b:a", opts.Bitrate)
+	}
+
+	if opts.Title != "" {
+		args = append(args, "-metadata", "title="+opts.Title)
+	}
+	if opts.Artist != "" {
+		args = append(args, "-metadata", "artist="+opts.Artist)
+	}
+	if opts.Album != "" {
+		args = append(args, "-metadata", "album="+opts.Album)
+	}
+
+	args = append(args, "-y", outputFilename)
+
+	cmd := exec.CommandContext(ctx, ffmpegBinary, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		err = errors.Wrapf(err, "ffmpeg transcode failed: %s", out)
+		return
+	}
+
+	if coverArtFile != "" {
+		os.Remove(coverArtFile)
+	}
+	os.Remove(input)
+	return
+}
+
+// convertToMp3 keeps the original simple entry point, converting to mp3 with
+// no normalization or tagging.
+func convertToMp3(ctx context.Context, filename string) (err error) {
+	_, err = Transcode(ctx, filename, TranscodeOptions{Codec: "mp3"})
+	return
+}
+
+type probeResult struct {
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+}
+
+func (p probeResult) durationSeconds() float64 {
+	var seconds float64
+	fmt.Sscanf(p.Format.Duration, "%f", &seconds)
+	return seconds
+}
+
+// probeAudio runs ffprobe on a file and parses its JSON output, used to
+// validate the file and detect truncated/corrupt downloads.
+func probeAudio(ctx context.Context, filename string) (result probeResult, err error) {
+	cmd := exec.CommandContext(ctx, ffprobeBinary(), "-v", "quiet", "-print_format", "json", "-show_format", filename)
+	out, err := cmd.Output()
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(out, &result)
+	return
+}
+
+// ffprobeBinary resolves ffprobe from the same place ffmpeg was resolved from.
+func ffprobeBinary() string {
+	if path, err := exec.LookPath("ffprobe"); err == nil {
+		return path
+	}
+	dir, file := filepath.Split(ffmpegBinary)
+	ext := filepath.Ext(file)
+	base := strings.TrimSuffix(file, ext)
+	return filepath.Join(dir, strings.Replace(base, "ffmpeg", "ffprobe", 1)+ext)
+}
+
+type loudnormMeasurement struct {
+	InputI      string `json:"input_i"`
+	InputTP     string `json:"input_tp"`
+	InputLRA    string `json:"input_lra"`
+	InputThresh string `json:"input_thresh"`
+}
+
+var loudnormJSONPattern = regexp.MustCompile(`(?s)\{[^{}]*"input_i"[^{}]*\}`)
+
+// measureLoudness runs the first loudnorm pass to measure the input's
+// integrated loudness, true peak and loudness range for the second pass.
+func measureLoudness(ctx context.Context, input string) (measurement loudnormMeasurement, err error) {
+	cmd := exec.CommandContext(ctx, ffmpegBinary, "-i", input, "-af", "loudnorm=I=-16:TP=-1.5:LRA=11:print_format=json", "-f", "null", "-")
+	out, _ := cmd.CombinedOutput()
+
+	match := loudnormJSONPattern.Find(out)
+	if match == nil {
+		err = fmt.Errorf("could not find loudnorm measurements in ffmpeg output")
+		return
+	}
+	err = json.Unmarshal(match, &measurement)
+	return
+}
+
+// youtubeThumbnailURL returns the always-available "high quality" thumbnail
+// for a video ID, used as the default cover art when a caller doesn't
+// override TranscodeOptions.CoverArtURL.
+func youtubeThumbnailURL(youtubeID string) string {
+	return fmt.Sprintf("https://i.ytimg.com/vi/%s/hqdefault.jpg", youtubeID)
+}
+
+// downloadCoverArt fetches a thumbnail to embed as cover art.
+func downloadCoverArt(ctx context.Context, url string, baseFilename string) (coverFile string, err error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return
+	}
+	resp, err := doWithRetry(ctx, req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		err = fmt.Errorf("received status code %d fetching cover art", resp.StatusCode)
+		return
+	}
+
+	coverFile = baseFilename + ".cover.jpg"
+	f, err := os.Create(coverFile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, resp.Body)
+	return
+}